@@ -16,6 +16,9 @@ type Digraph struct {
 // NewDigraph creates a new directed graph with the specified edges and number
 // of nodes. It is important to ensure that edges are only between nodes within
 // the range [0, nNodes); otherwise, the function will panic.
+//
+// The edges are copied so that the caller remains free to modify or reuse the
+// edges slice after the call.
 func NewDigraph(edges []Edge, nNodes int) *Digraph {
 	dg := &Digraph{
 		Nexts: make([][]int, nNodes),
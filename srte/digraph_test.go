@@ -88,3 +88,19 @@ func TestNewDigraph(t *testing.T) {
 		})
 	}
 }
+
+func TestNewDigraph_copiesEdges(t *testing.T) {
+	edges := []Edge{{0, 1, 1}, {1, 2, 1}}
+	want := &Digraph{
+		Nexts: [][]int{{0}, {1}, nil},
+		Edges: []Edge{{0, 1, 1}, {1, 2, 1}},
+	}
+
+	got := NewDigraph(edges, 3)
+	edges[0] = Edge{2, 0, 5}
+	edges[1].Cost = 10
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("NewDigraph(): mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -17,51 +17,267 @@ type EdgeRatio struct {
 }
 
 type FGraphs struct {
-	edgesRatios [][][]EdgeRatio
+	nNodes int
+	edges  []Edge // copy of the graph's edges
+
+	// The edge ratios of all the forwarding graphs are stored contiguously in
+	// a single arena. The ratios of the forwarding graph from s to t are the
+	// elements ratios[offsets[i]:offsets[i+1]] where i = s*nNodes + t. In
+	// compact mode, ratios is nil and the arena is compactRatios instead.
+	offsets       []int
+	ratios        []EdgeRatio
+	compactRatios []compactRatio
+
+	// Cost of the shortest paths from s to t at index s*nNodes + t.
+	distances []int
+}
+
+// compactRatio is the compact counterpart of EdgeRatio. It takes half the
+// memory of an EdgeRatio on 64-bit platforms.
+type compactRatio struct {
+	Edge  int32
+	Ratio float32
+}
+
+// FGraphsOption configures optional behaviors of FGraphs.
+type FGraphsOption func(*fgraphsConfig)
+
+type fgraphsConfig struct {
+	compact bool
+	split   SplitPolicy
+	maxECMP int
+}
+
+// WithMaxECMP limits the number of next hops used by each node to forward
+// traffic towards a destination. What a next hop is depends on the split
+// policy (see WithSplitPolicy):
+//   - with SplitPerEdge, a next hop is an outgoing shortest-path edge and only
+//     the k edges with the lowest indices are used;
+//   - with SplitPerNeighbor, a next hop is a distinct neighbor node on the
+//     shortest paths and only the k neighbors with the lowest node IDs are
+//     used, together with all the parallel edges leading to them.
+//
+// The load is then split among the remaining next hops. A limit of 0 or less
+// means that the number of next hops is not limited.
+func WithMaxECMP(k int) FGraphsOption {
+	return func(c *fgraphsConfig) {
+		c.maxECMP = k
+	}
+}
+
+// SplitPolicy defines how a node splits the load it forwards among its next
+// hops on the shortest paths.
+type SplitPolicy int
+
+const (
+	// SplitPerEdge splits the load equally among the outgoing shortest-path
+	// edges of a node. Parallel edges count as separate next hops. This is the
+	// default policy.
+	SplitPerEdge SplitPolicy = iota
+
+	// SplitPerNeighbor splits the load equally among the distinct next-hop
+	// nodes of a node, and then equally among the parallel edges leading to
+	// each of these next-hop nodes.
+	SplitPerNeighbor
+)
+
+// WithSplitPolicy sets the policy used to split load among next hops.
+func WithSplitPolicy(p SplitPolicy) FGraphsOption {
+	return func(c *fgraphsConfig) {
+		c.split = p
+	}
+}
+
+// WithCompactRatios makes FGraphs store ratios as float32 (and edges as int32)
+// which halves the memory used by the forwarding graphs.
+//
+// Ratios that are dyadic fractions (k/2^n with n <= 24, e.g. 1/2, 3/4, 1/8)
+// are stored exactly. Other ratios (e.g. 1/3, 1/6) are rounded to the nearest
+// float32 which introduces a relative error of at most 2^-24 (about 6e-8).
+// Note that, in compact mode, EdgeRatios allocates the slice it returns; use
+// ForEachEdgeRatio to avoid allocations.
+func WithCompactRatios() FGraphsOption {
+	return func(c *fgraphsConfig) {
+		c.compact = true
+	}
 }
 
 // EdgeRatios returns the list of EdgeRatio pairs on the forwarding graph from
 // node s to node t.
+//
+// Important: unless FGraphs is in compact mode, the slice is a view on the
+// FGraphs' internal storage and should only be used in read-only operations.
 func (fgs *FGraphs) EdgeRatios(s int, t int) []EdgeRatio {
-	return fgs.edgesRatios[s][t]
+	i := s*fgs.nNodes + t
+	from, to := fgs.offsets[i], fgs.offsets[i+1]
+	if fgs.compactRatios == nil {
+		return fgs.ratios[from:to:to]
+	}
+	ers := make([]EdgeRatio, 0, to-from)
+	for _, cr := range fgs.compactRatios[from:to] {
+		ers = append(ers, EdgeRatio{int(cr.Edge), float64(cr.Ratio)})
+	}
+	return ers
+}
+
+// ForEachEdgeRatio calls fn for each EdgeRatio pair on the forwarding graph
+// from node s to node t, in increasing order of edge. Contrary to EdgeRatios,
+// ForEachEdgeRatio never allocates.
+func (fgs *FGraphs) ForEachEdgeRatio(s int, t int, fn func(EdgeRatio)) {
+	i := s*fgs.nNodes + t
+	from, to := fgs.offsets[i], fgs.offsets[i+1]
+	if fgs.compactRatios == nil {
+		for _, er := range fgs.ratios[from:to] {
+			fn(er)
+		}
+		return
+	}
+	for _, cr := range fgs.compactRatios[from:to] {
+		fn(EdgeRatio{int(cr.Edge), float64(cr.Ratio)})
+	}
+}
+
+// Distance returns the cost of the shortest paths from node s to node t, or
+// math.MaxInt if t is not reachable from s.
+func (fgs *FGraphs) Distance(s int, t int) int {
+	return fgs.distances[s*fgs.nNodes+t]
+}
+
+// Paths returns up to limit shortest paths from node s to node t, each path
+// being the sequence of nodes from s to t on the forwarding graph. The number
+// of shortest paths can be exponential in the size of the graph, hence the
+// limit. Paths are enumerated in lexicographic order of their node sequence.
+// Parallel edges between two consecutive nodes do not yield distinct paths.
+//
+// Paths returns nil if limit <= 0, s == t, or t is not reachable from s.
+func (fgs *FGraphs) Paths(s int, t int, limit int) [][]int {
+	if limit <= 0 || s == t {
+		return nil
+	}
+
+	// Next nodes of each node in the forwarding graph, sorted and unique.
+	nexts := map[int][]int{}
+	fgs.ForEachEdgeRatio(s, t, func(er EdgeRatio) {
+		e := fgs.edges[er.Edge]
+		nexts[e.From] = append(nexts[e.From], e.To)
+	})
+	for u, vs := range nexts {
+		sort.Ints(vs)
+		n := 0
+		for i, v := range vs {
+			if i == 0 || vs[i-1] != v {
+				vs[n] = v
+				n++
+			}
+		}
+		nexts[u] = vs[:n]
+	}
+
+	var paths [][]int
+	path := []int{s}
+	var visit func(u int)
+	visit = func(u int) {
+		if u == t {
+			paths = append(paths, append([]int(nil), path...))
+			return
+		}
+		for _, v := range nexts[u] {
+			if len(paths) == limit {
+				return
+			}
+			path = append(path, v)
+			visit(v)
+			path = path[:len(path)-1]
+		}
+	}
+	visit(s)
+
+	return paths
 }
 
-func NewFGraphs(g *Digraph) (*FGraphs, error) {
+// NewFGraphs computes the forwarding graphs of all the pairs of nodes in g.
+//
+// FGraphs does not keep any reference to g: everything is computed at
+// construction and the data needed afterwards (e.g. the edges' endpoints) is
+// copied. Changes made to g after the call are thus not reflected in the
+// returned FGraphs, which must be rebuilt to take them into account.
+func NewFGraphs(g *Digraph, opts ...FGraphsOption) (*FGraphs, error) {
+	cfg := fgraphsConfig{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.compact && len(g.Edges) > math.MaxInt32 {
+		return nil, fmt.Errorf("too many edges for compact ratios: %d", len(g.Edges))
+	}
+
 	nNodes := len(g.Nexts)
 
 	fgs := &FGraphs{
-		edgesRatios: make([][][]EdgeRatio, nNodes),
+		nNodes:    nNodes,
+		edges:     append([]Edge(nil), g.Edges...),
+		offsets:   make([]int, nNodes*nNodes+1),
+		distances: make([]int, nNodes*nNodes),
 	}
 
+	ers := []EdgeRatio{} // ratios of the current forwarding graph
+	arenaLen := 0
 	for u := 0; u < nNodes; u++ {
-		fgs.edgesRatios[u] = make([][]EdgeRatio, nNodes)
-
-		prevs, err := shortestDAG(g, u)
+		prevs, costs, err := shortestDAG(g, u)
 		if err != nil {
 			return nil, err
 		}
+		copy(fgs.distances[u*nNodes:], costs)
 
 		for v := 0; v < nNodes; v++ {
+			fgs.offsets[u*nNodes+v] = arenaLen
 			if u == v {
 				continue
 			}
-			edgeRatiosMap := forwardingGraph(g, prevs, u, v)
-			fgs.edgesRatios[u][v] = make([]EdgeRatio, 0, len(edgeRatiosMap))
-			for e, r := range edgeRatiosMap {
-				fgs.edgesRatios[u][v] = append(fgs.edgesRatios[u][v], EdgeRatio{
+
+			ers = ers[:0]
+			for e, r := range forwardingGraph(g, prevs, u, v, &cfg) {
+				ers = append(ers, EdgeRatio{
 					Edge:  e,
 					Ratio: r,
 				})
 			}
-			sort.Slice(fgs.edgesRatios[u][v], func(i, j int) bool {
-				return fgs.edgesRatios[u][v][i].Edge < fgs.edgesRatios[u][v][j].Edge
+			sort.Slice(ers, func(i, j int) bool {
+				return ers[i].Edge < ers[j].Edge
 			})
+
+			arenaLen += len(ers)
+			if !cfg.compact {
+				fgs.ratios = append(fgs.ratios, ers...)
+				continue
+			}
+			for _, er := range ers {
+				fgs.compactRatios = append(fgs.compactRatios, compactRatio{
+					Edge:  int32(er.Edge),
+					Ratio: float32(er.Ratio),
+				})
+			}
 		}
 	}
+	fgs.offsets[nNodes*nNodes] = arenaLen
+
+	// The arena was grown by successive appends and thus has spare capacity.
+	// Copy it to a slice of the exact size so that only the ratios are kept.
+	if cfg.compact {
+		fgs.compactRatios = exactCopy(fgs.compactRatios)
+	} else {
+		fgs.ratios = exactCopy(fgs.ratios)
+	}
 
 	return fgs, nil
 }
 
+// exactCopy returns a copy of s whose capacity is its length.
+func exactCopy[T any](s []T) []T {
+	c := make([]T, len(s))
+	copy(c, s)
+	return c
+}
+
 // foardingGraph computes the fraction of load sent on each edge when sending
 // traffic from node s to node t.
 //
@@ -72,17 +288,19 @@ func NewFGraphs(g *Digraph) (*FGraphs, error) {
 //   - loadIn[t] = 0 and loadOut[t] = 1,
 //   - loadIn[n] = loadOut[n] for all node n != s, t.
 //
-// The algorithm operates in two phase. The first phase traverses prevs
+// The algorithm operates in three phases. The first phase traverses prevs
 // from t to s to compute the DAG of all the shortest paths from s to t.
-// The second phase traverses that DAG to compute the fraction of load sent
-// over each edge from s to t.
+// The second phase removes the edges of the DAG that exceed the maximum ECMP
+// fan-out in cfg (if any). The third phase traverses that DAG to compute the
+// fraction of load sent over each edge from s to t, according to the split
+// policy in cfg.
 //
 // Compute the fraction of traffic sent on each edge. For any edge (u, v),
 // the total fraction of traffic received at node u must be computed before
 // computing the fraction sent on the edge. This is done by processing the
 // nodes in their topological order.
-func forwardingGraph(g *Digraph, prevs [][]int, s int, t int) map[int]float64 {
-	queue := []int{} // used by both steps below
+func forwardingGraph(g *Digraph, prevs [][]int, s int, t int, cfg *fgraphsConfig) map[int]float64 {
+	queue := []int{} // used by steps 1 and 3 below
 	nNodes := len(g.Nexts)
 
 	// Step 1: extract DAG
@@ -107,7 +325,13 @@ func forwardingGraph(g *Digraph, prevs [][]int, s int, t int) map[int]float64 {
 		}
 	}
 
-	// Step 2: Compute load ratios
+	// Step 2: Limit ECMP fan-out
+	// --------------------------
+	if cfg.maxECMP > 0 {
+		limitFanOut(g, nexts, degrees, s, cfg.maxECMP, cfg.split)
+	}
+
+	// Step 3: Compute load ratios
 	// ---------------------------
 	nodeLoad := make([]float64, nNodes)
 	edgeLoad := make(map[int]float64) // result
@@ -117,38 +341,124 @@ func forwardingGraph(g *Digraph, prevs [][]int, s int, t int) map[int]float64 {
 	nodeLoad[s] = 1.0
 	for i := 0; i < len(queue); i++ {
 		u := queue[i]
-		for _, e := range nexts[u] {
-			v := g.Edges[e].To
+		hops := nexts[u]
 
-			l := nodeLoad[u] / float64(len(nexts[u]))
-			edgeLoad[e] = l
-			nodeLoad[v] += l
+		// Load sent to each next hop. With the per-neighbor policy, parallel
+		// edges are grouped (contiguously) into a single next hop.
+		hopLoad := nodeLoad[u] / float64(len(hops))
+		if cfg.split == SplitPerNeighbor {
+			sort.Slice(hops, func(a, b int) bool {
+				return g.Edges[hops[a]].To < g.Edges[hops[b]].To
+			})
+			hopLoad = nodeLoad[u] / float64(countNeighbors(g, hops))
+		}
 
-			degrees[v] -= 1
-			if degrees[v] == 0 {
-				queue = append(queue, v)
+		for j := 0; j < len(hops); {
+			v := g.Edges[hops[j]].To
+			k := j + 1
+			if cfg.split == SplitPerNeighbor {
+				for k < len(hops) && g.Edges[hops[k]].To == v {
+					k++
+				}
 			}
+
+			l := hopLoad / float64(k-j)
+			for _, e := range hops[j:k] {
+				edgeLoad[e] = l
+				nodeLoad[v] += l
+
+				degrees[v] -= 1
+				if degrees[v] == 0 {
+					queue = append(queue, v)
+				}
+			}
+			j = k
 		}
 	}
 
 	return edgeLoad
 }
 
+// limitFanOut removes from the DAG all the edges but the k next hops of each
+// node. With SplitPerEdge, the next hops kept are the k edges with the lowest
+// indices. With SplitPerNeighbor, they are all the edges leading to the k
+// neighbors with the lowest node IDs. The in-degrees of the nodes are updated
+// to only count the edges whose origin is still reachable from s.
+func limitFanOut(g *Digraph, nexts [][]int, degrees []int, s int, k int, split SplitPolicy) {
+	for u, es := range nexts {
+		if len(es) <= k {
+			continue
+		}
+		if split != SplitPerNeighbor {
+			sort.Ints(es)
+			nexts[u] = es[:k]
+			continue
+		}
+		sort.Slice(es, func(a, b int) bool {
+			ea, eb := g.Edges[es[a]], g.Edges[es[b]]
+			if ea.To != eb.To {
+				return ea.To < eb.To
+			}
+			return es[a] < es[b]
+		})
+		n := 0 // number of neighbors kept so far
+		for i, e := range es {
+			if i == 0 || g.Edges[es[i-1]].To != g.Edges[e].To {
+				n++
+			}
+			if n > k {
+				nexts[u] = es[:i]
+				break
+			}
+		}
+	}
+
+	for v := range degrees {
+		degrees[v] = 0
+	}
+	reached := make([]bool, len(nexts))
+	reached[s] = true
+	queue := []int{s}
+	for i := 0; i < len(queue); i++ {
+		for _, e := range nexts[queue[i]] {
+			v := g.Edges[e].To
+			degrees[v] += 1
+			if !reached[v] {
+				reached[v] = true
+				queue = append(queue, v)
+			}
+		}
+	}
+}
+
+// countNeighbors returns the number of distinct destination nodes of the given
+// edges. Edges must be sorted by destination node.
+func countNeighbors(g *Digraph, edges []int) int {
+	n := 0
+	for i, e := range edges {
+		if i == 0 || g.Edges[edges[i-1]].To != g.Edges[e].To {
+			n++
+		}
+	}
+	return n
+}
+
 // shortestDAG computes and returns a DAG that encapsulates the shortest paths
 // from a specified source node src to all other nodes within the digraph g.
 //
 // This function returns a slice that maps each node v in the graph o a list of
 // incoming edges (u, v), where each edge represents a part of the shortest path
 // from src to v. If a node v is unreachable from src, its corresponding list
-// will be empty.
-func shortestDAG(g *Digraph, src int) ([][]int, error) {
+// will be empty. The second returned slice contains the cost of the shortest
+// paths from src to each node v, or math.MaxInt if v is unreachable.
+func shortestDAG(g *Digraph, src int) ([][]int, []int, error) {
 	if g == nil {
-		return nil, fmt.Errorf("digraph is nil")
+		return nil, nil, fmt.Errorf("digraph is nil")
 	}
 
 	nNodes := len(g.Nexts)
 	if src < 0 || nNodes <= src {
-		return nil, fmt.Errorf("node %d is not in the graph", src)
+		return nil, nil, fmt.Errorf("node %d is not in the graph", src)
 	}
 
 	prevs := make([][]int, nNodes)
@@ -187,5 +497,5 @@ func shortestDAG(g *Digraph, src int) ([][]int, error) {
 		}
 	}
 
-	return prevs, nil
+	return prevs, costs, nil
 }
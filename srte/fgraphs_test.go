@@ -1,15 +1,20 @@
 package srte
 
 import (
+	"math"
+	"runtime"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 func TestFGraphs_EdgeRatios(t *testing.T) {
 	want := []EdgeRatio{{1, 0.1}, {2, 0.2}, {3, 0.3}}
 	fgs := FGraphs{
-		edgesRatios: [][][]EdgeRatio{{{}, want}},
+		nNodes:  2,
+		offsets: []int{0, 0, 3, 5, 5},
+		ratios:  append(want, EdgeRatio{4, 0.4}, EdgeRatio{5, 0.5}),
 	}
 
 	got := fgs.EdgeRatios(0, 1)
@@ -19,41 +24,608 @@ func TestFGraphs_EdgeRatios(t *testing.T) {
 	}
 }
 
+func TestFGraphs_ForEachEdgeRatio(t *testing.T) {
+	want := []EdgeRatio{{1, 0.1}, {2, 0.2}, {3, 0.3}}
+	fgs := FGraphs{
+		nNodes:  2,
+		offsets: []int{0, 0, 3, 5, 5},
+		ratios:  append(want, EdgeRatio{4, 0.4}, EdgeRatio{5, 0.5}),
+	}
+
+	got := []EdgeRatio{}
+	fgs.ForEachEdgeRatio(0, 1, func(er EdgeRatio) {
+		got = append(got, er)
+	})
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ForEachEdgeRatio(): mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNew_compactRatios(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		graph   *Digraph
+		wantErr float64 // max relative error
+	}{
+		{
+			// 0-->1-->3-->4
+			// |       ^
+			// +-->2---+
+			desc: "dyadic ratios",
+			graph: NewDigraph([]Edge{
+				{0, 1, 1}, {1, 3, 1}, {3, 4, 1},
+				{0, 2, 1}, {2, 3, 1},
+			}, 5),
+			wantErr: 0,
+		},
+		{
+			//  +-->1---+
+			//  |       v
+			//  0-->2-->4
+			//  |       ^
+			//  +-->3---+
+			desc: "ternary ratios",
+			graph: NewDigraph([]Edge{
+				{0, 1, 1}, {1, 4, 1},
+				{0, 2, 1}, {2, 4, 1},
+				{0, 3, 1}, {3, 4, 1},
+			}, 5),
+			wantErr: 1.0 / (1 << 24),
+		},
+		{
+			desc:    "grid",
+			graph:   gridDigraph(5, 6),
+			wantErr: 1.0 / (1 << 24),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			want, err := NewFGraphs(tc.graph)
+			if err != nil {
+				t.Fatalf("NewFGraphs(): want no error, got %s", err)
+			}
+			got, err := NewFGraphs(tc.graph, WithCompactRatios())
+			if err != nil {
+				t.Fatalf("NewFGraphs(compact): want no error, got %s", err)
+			}
+
+			relErr := cmp.Comparer(func(a, b float64) bool {
+				return math.Abs(a-b) <= tc.wantErr*math.Abs(a)
+			})
+			if diff := cmp.Diff(allEdgeRatios(want), allEdgeRatios(got), relErr, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("NewFGraphs(compact): mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFGraphs_ForEachEdgeRatio_noAlloc(t *testing.T) {
+	fgs, err := NewFGraphs(gridDigraph(3, 3), WithCompactRatios())
+	if err != nil {
+		t.Fatalf("NewFGraphs(): want no error, got %s", err)
+	}
+	sum := 0.0
+
+	allocs := testing.AllocsPerRun(10, func() {
+		fgs.ForEachEdgeRatio(0, 8, func(er EdgeRatio) {
+			sum += er.Ratio
+		})
+	})
+
+	if allocs != 0 {
+		t.Errorf("ForEachEdgeRatio(): want 0 allocations, got %f", allocs)
+	}
+}
+
+func TestNew_splitPolicy(t *testing.T) {
+	//   +==>1---+
+	//   |       v
+	//   0       2
+	//   |       ^
+	//   +-->3---+
+	graph := NewDigraph([]Edge{
+		{0, 1, 1}, // edge: 0
+		{0, 1, 1}, // edge: 1 (parallel to edge 0)
+		{1, 2, 1}, // edge: 2
+		{0, 3, 1}, // edge: 3
+		{3, 2, 1}, // edge: 4
+	}, 4)
+	testCases := []struct {
+		desc   string
+		policy SplitPolicy
+		want   []EdgeRatio
+	}{
+		{
+			desc:   "per edge",
+			policy: SplitPerEdge,
+			want: []EdgeRatio{
+				{0, 1.0 / 3},
+				{1, 1.0 / 3},
+				{2, 2.0 / 3},
+				{3, 1.0 / 3},
+				{4, 1.0 / 3},
+			},
+		},
+		{
+			desc:   "per neighbor",
+			policy: SplitPerNeighbor,
+			want: []EdgeRatio{
+				{0, 0.25},
+				{1, 0.25},
+				{2, 0.5},
+				{3, 0.5},
+				{4, 0.5},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			fgs, err := NewFGraphs(graph, WithSplitPolicy(tc.policy))
+			if err != nil {
+				t.Fatalf("NewFGraphs(): want no error, got %s", err)
+			}
+
+			got := fgs.EdgeRatios(0, 2)
+
+			if diff := cmp.Diff(tc.want, got, cmpopts.EquateApprox(0, 1e-12)); diff != "" {
+				t.Errorf("EdgeRatios(0, 2): mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNew_splitPolicy_noParallelEdges(t *testing.T) {
+	graph := gridDigraph(4, 4)
+	want, err := NewFGraphs(graph)
+	if err != nil {
+		t.Fatalf("NewFGraphs(): want no error, got %s", err)
+	}
+
+	got, err := NewFGraphs(graph, WithSplitPolicy(SplitPerNeighbor))
+	if err != nil {
+		t.Fatalf("NewFGraphs(): want no error, got %s", err)
+	}
+
+	if diff := cmp.Diff(allEdgeRatios(want), allEdgeRatios(got), cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("NewFGraphs(): mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestFGraphs_Paths(t *testing.T) {
+	// 0<--1<--2
+	//     ^   ^
+	//     |   |
+	//     3<--4
+	bridge := NewDigraph([]Edge{
+		{1, 0, 1}, // edge: 0
+		{2, 1, 1}, // edge: 1
+		{3, 1, 1}, // edge: 2
+		{4, 2, 1}, // edge: 3
+		{4, 3, 1}, // edge: 4
+	}, 5)
+	// 0==>1-->2
+	//  \      ^
+	//   +-->3-+
+	parallel := NewDigraph([]Edge{
+		{0, 1, 1}, // edge: 0
+		{0, 1, 1}, // edge: 1
+		{1, 2, 1}, // edge: 2
+		{0, 3, 1}, // edge: 3
+		{3, 2, 1}, // edge: 4
+	}, 4)
+	testCases := []struct {
+		desc  string
+		graph *Digraph
+		s     int
+		t     int
+		limit int
+		want  [][]int
+	}{
+		{
+			desc:  "two paths",
+			graph: bridge,
+			s:     4,
+			t:     0,
+			limit: 10,
+			want:  [][]int{{4, 2, 1, 0}, {4, 3, 1, 0}},
+		},
+		{
+			desc:  "limit",
+			graph: bridge,
+			s:     4,
+			t:     0,
+			limit: 1,
+			want:  [][]int{{4, 2, 1, 0}},
+		},
+		{
+			desc:  "zero limit",
+			graph: bridge,
+			s:     4,
+			t:     0,
+			limit: 0,
+			want:  nil,
+		},
+		{
+			desc:  "single path",
+			graph: bridge,
+			s:     2,
+			t:     0,
+			limit: 10,
+			want:  [][]int{{2, 1, 0}},
+		},
+		{
+			desc:  "unreachable",
+			graph: bridge,
+			s:     0,
+			t:     4,
+			limit: 10,
+			want:  nil,
+		},
+		{
+			desc:  "same node",
+			graph: bridge,
+			s:     1,
+			t:     1,
+			limit: 10,
+			want:  nil,
+		},
+		{
+			desc:  "parallel edges",
+			graph: parallel,
+			s:     0,
+			t:     2,
+			limit: 10,
+			want:  [][]int{{0, 1, 2}, {0, 3, 2}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			fgs, err := NewFGraphs(tc.graph)
+			if err != nil {
+				t.Fatalf("NewFGraphs(): want no error, got %s", err)
+			}
+
+			got := fgs.Paths(tc.s, tc.t, tc.limit)
+
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Paths(): mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestFGraphs_Paths_matchRatios verifies that the ratio of each edge is the
+// probability that a path traverses it when each node picks one of its next
+// hops uniformly at random (which is how the default split policy works).
+func TestFGraphs_Paths_matchRatios(t *testing.T) {
+	graph := gridDigraph(4, 5)
+	nNodes := len(graph.Nexts)
+	fgs, err := NewFGraphs(graph)
+	if err != nil {
+		t.Fatalf("NewFGraphs(): want no error, got %s", err)
+	}
+
+	for s := 0; s < nNodes; s++ {
+		for d := 0; d < nNodes; d++ {
+			if s == d {
+				continue
+			}
+			ratios := fgs.EdgeRatios(s, d)
+			outDegree := map[int]int{}
+			edgeOf := map[[2]int]int{}
+			for _, er := range ratios {
+				e := graph.Edges[er.Edge]
+				outDegree[e.From]++
+				edgeOf[[2]int{e.From, e.To}] = er.Edge
+			}
+
+			got := map[int]float64{}
+			for _, path := range fgs.Paths(s, d, math.MaxInt) {
+				p := 1.0
+				for i := 1; i < len(path); i++ {
+					p /= float64(outDegree[path[i-1]])
+				}
+				for i := 1; i < len(path); i++ {
+					got[edgeOf[[2]int{path[i-1], path[i]}]] += p
+				}
+			}
+
+			want := map[int]float64{}
+			for _, er := range ratios {
+				want[er.Edge] = er.Ratio
+			}
+			if diff := cmp.Diff(want, got, cmpopts.EquateApprox(0, 1e-9)); diff != "" {
+				t.Errorf("Paths(%d, %d): ratios mismatch (-want +got):\n%s", s, d, diff)
+			}
+		}
+	}
+}
+
+func TestNew_maxECMP(t *testing.T) {
+	//   +-->1---+
+	//   +-->2---+
+	//   0       5-->6
+	//   +-->3---+
+	//   +-->4---+
+	graph := NewDigraph([]Edge{
+		{0, 4, 1}, // edge: 0
+		{0, 3, 1}, // edge: 1
+		{0, 2, 1}, // edge: 2
+		{0, 1, 1}, // edge: 3
+		{1, 5, 1}, // edge: 4
+		{2, 5, 1}, // edge: 5
+		{3, 5, 1}, // edge: 6
+		{4, 5, 1}, // edge: 7
+		{5, 6, 1}, // edge: 8
+	}, 7)
+	testCases := []struct {
+		desc    string
+		maxECMP int
+		want    []EdgeRatio
+	}{
+		{
+			desc:    "no limit",
+			maxECMP: 0,
+			want: []EdgeRatio{
+				{0, 0.25}, {1, 0.25}, {2, 0.25}, {3, 0.25},
+				{4, 0.25}, {5, 0.25}, {6, 0.25}, {7, 0.25},
+				{8, 1},
+			},
+		},
+		{
+			desc:    "limit above fan-out",
+			maxECMP: 8,
+			want: []EdgeRatio{
+				{0, 0.25}, {1, 0.25}, {2, 0.25}, {3, 0.25},
+				{4, 0.25}, {5, 0.25}, {6, 0.25}, {7, 0.25},
+				{8, 1},
+			},
+		},
+		{
+			desc:    "limit below fan-out",
+			maxECMP: 2,
+			want: []EdgeRatio{
+				{0, 0.5}, {1, 0.5},
+				{6, 0.5}, {7, 0.5},
+				{8, 1},
+			},
+		},
+		{
+			desc:    "single next hop",
+			maxECMP: 1,
+			want:    []EdgeRatio{{0, 1}, {7, 1}, {8, 1}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			fgs, err := NewFGraphs(graph, WithMaxECMP(tc.maxECMP))
+			if err != nil {
+				t.Fatalf("NewFGraphs(): want no error, got %s", err)
+			}
+
+			got := fgs.EdgeRatios(0, 6)
+
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("EdgeRatios(0, 6): mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNew_maxECMP_splitPolicy(t *testing.T) {
+	//   +==>1---+
+	//   |       v
+	//   0       3
+	//   |       ^
+	//   +-->2---+
+	graph := NewDigraph([]Edge{
+		{0, 1, 1}, // edge: 0
+		{0, 1, 1}, // edge: 1 (parallel to edge 0)
+		{0, 2, 1}, // edge: 2
+		{1, 3, 1}, // edge: 3
+		{2, 3, 1}, // edge: 4
+	}, 4)
+	testCases := []struct {
+		desc    string
+		policy  SplitPolicy
+		maxECMP int
+		want    []EdgeRatio
+	}{
+		{
+			desc:    "per edge, two next hops",
+			policy:  SplitPerEdge,
+			maxECMP: 2,
+			want:    []EdgeRatio{{0, 0.5}, {1, 0.5}, {3, 1}},
+		},
+		{
+			desc:    "per edge, one next hop",
+			policy:  SplitPerEdge,
+			maxECMP: 1,
+			want:    []EdgeRatio{{0, 1}, {3, 1}},
+		},
+		{
+			desc:    "per neighbor, two next hops",
+			policy:  SplitPerNeighbor,
+			maxECMP: 2,
+			want: []EdgeRatio{
+				{0, 0.25}, {1, 0.25}, {2, 0.5},
+				{3, 0.5}, {4, 0.5},
+			},
+		},
+		{
+			desc:    "per neighbor, one next hop",
+			policy:  SplitPerNeighbor,
+			maxECMP: 1,
+			want:    []EdgeRatio{{0, 0.5}, {1, 0.5}, {3, 1}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			fgs, err := NewFGraphs(graph, WithSplitPolicy(tc.policy), WithMaxECMP(tc.maxECMP))
+			if err != nil {
+				t.Fatalf("NewFGraphs(): want no error, got %s", err)
+			}
+
+			got := fgs.EdgeRatios(0, 3)
+
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("EdgeRatios(0, 3): mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestNew_maxECMP_conservation verifies that, when limiting the fan-out, the
+// load is still conserved on every node even when nodes of the shortest-path
+// DAG are not used anymore.
+func TestNew_maxECMP_conservation(t *testing.T) {
+	graph := gridDigraph(5, 5)
+	nNodes := len(graph.Nexts)
+
+	for _, k := range []int{1, 2} {
+		fgs, err := NewFGraphs(graph, WithMaxECMP(k))
+		if err != nil {
+			t.Fatalf("NewFGraphs(): want no error, got %s", err)
+		}
+		for s := 0; s < nNodes; s++ {
+			for d := 0; d < nNodes; d++ {
+				if s == d {
+					continue
+				}
+				loadIn := make([]float64, nNodes)
+				loadOut := make([]float64, nNodes)
+				fanOut := make([]int, nNodes)
+				for _, er := range fgs.EdgeRatios(s, d) {
+					e := graph.Edges[er.Edge]
+					loadOut[e.From] += er.Ratio
+					loadIn[e.To] += er.Ratio
+					fanOut[e.From]++
+				}
+				loadIn[s] += 1
+				loadOut[d] += 1
+				for n := 0; n < nNodes; n++ {
+					if math.Abs(loadIn[n]-loadOut[n]) > 1e-9 {
+						t.Errorf("k=%d, EdgeRatios(%d, %d): node %d: load in %f != load out %f", k, s, d, n, loadIn[n], loadOut[n])
+					}
+					if fanOut[n] > k {
+						t.Errorf("k=%d, EdgeRatios(%d, %d): node %d: fan-out %d", k, s, d, n, fanOut[n])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestNew_independentFromGraph(t *testing.T) {
+	// 0-->1-->2
+	// |       ^
+	// +-->3---+
+	edges := []Edge{
+		{0, 1, 1}, // edge: 0
+		{1, 2, 1}, // edge: 1
+		{0, 3, 1}, // edge: 2
+		{3, 2, 1}, // edge: 3
+	}
+	graph := NewDigraph(edges, 4)
+	fgs, err := NewFGraphs(graph)
+	if err != nil {
+		t.Fatalf("NewFGraphs(): want no error, got %s", err)
+	}
+	wantRatios := allEdgeRatios(fgs)
+	wantPaths := fgs.Paths(0, 2, 10)
+	wantDistance := fgs.Distance(0, 2)
+
+	// Mutate both the caller's edges and the graph itself.
+	edges[0].Cost = 10
+	graph.Edges[2] = Edge{2, 0, 1}
+	graph.Edges[3].Cost = 10
+	graph.Nexts[0] = append(graph.Nexts[0], 1)
+
+	if diff := cmp.Diff(wantRatios, allEdgeRatios(fgs)); diff != "" {
+		t.Errorf("EdgeRatios(): mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(wantPaths, fgs.Paths(0, 2, 10)); diff != "" {
+		t.Errorf("Paths(0, 2): mismatch (-want +got):\n%s", diff)
+	}
+	if got := fgs.Distance(0, 2); got != wantDistance {
+		t.Errorf("Distance(0, 2): want %d, got %d", wantDistance, got)
+	}
+}
+
+func TestFGraphs_Distance(t *testing.T) {
+	// 0-->1-->2-->3
+	// |   ^       ^
+	// |   |       |
+	// +-->4------>5   6
+	graph := NewDigraph([]Edge{
+		{0, 1, 2}, // edge: 0
+		{1, 2, 2}, // edge: 1
+		{2, 3, 1}, // edge: 2
+		{0, 4, 1}, // edge: 3
+		{4, 1, 1}, // edge: 4
+		{4, 5, 3}, // edge: 5
+		{5, 3, 1}, // edge: 6
+	}, 7)
+	inf := math.MaxInt
+	want := [][]int{
+		{0, 2, 4, 5, 1, 4, inf},
+		{inf, 0, 2, 3, inf, inf, inf},
+		{inf, inf, 0, 1, inf, inf, inf},
+		{inf, inf, inf, 0, inf, inf, inf},
+		{inf, 1, 3, 4, 0, 3, inf},
+		{inf, inf, inf, 1, inf, 0, inf},
+		{inf, inf, inf, inf, inf, inf, 0},
+	}
+
+	fgs, err := NewFGraphs(graph)
+	if err != nil {
+		t.Fatalf("NewFGraphs(): want no error, got %s", err)
+	}
+
+	for s := range want {
+		for d := range want[s] {
+			if got := fgs.Distance(s, d); got != want[s][d] {
+				t.Errorf("Distance(%d, %d): want %d, got %d", s, d, want[s][d], got)
+			}
+		}
+	}
+}
+
 func TestNew(t *testing.T) {
 	testCases := []struct {
 		desc    string
 		graph   *Digraph
-		want    *FGraphs
+		want    [][][]EdgeRatio
 		wantErr bool
 	}{
 		{
 			desc:  "empty graph",
 			graph: NewDigraph(nil, 0),
-			want: &FGraphs{
-				[][][]EdgeRatio{},
-			},
+			want:  [][][]EdgeRatio{},
 		},
 		{
 			desc:  "single node",
 			graph: NewDigraph(nil, 1),
-			want: &FGraphs{
-				[][][]EdgeRatio{{nil}},
-			},
+			want:  [][][]EdgeRatio{{nil}},
 		},
 		{
 			// 0-->1
 			desc:  "one edge",
 			graph: NewDigraph([]Edge{{0, 1, 0}}, 2),
-			want: &FGraphs{
-				[][][]EdgeRatio{
-					{
-						nil,      // 0 -> 0
-						{{0, 1}}, // 0 -> 1
-					},
-					{
-						{},  // 1 -> 0
-						nil, // 1 -> 1
-					},
+			want: [][][]EdgeRatio{
+				{
+					nil,      // 0 -> 0
+					{{0, 1}}, // 0 -> 1
+				},
+				{
+					{},  // 1 -> 0
+					nil, // 1 -> 1
 				},
 			},
 		},
@@ -61,32 +633,30 @@ func TestNew(t *testing.T) {
 			// 0-->1   2-->3
 			desc:  "not connected",
 			graph: NewDigraph([]Edge{{0, 1, 1}, {2, 3, 1}}, 4),
-			want: &FGraphs{
-				[][][]EdgeRatio{
-					{
-						nil,      // 0 -> 0
-						{{0, 1}}, // 0 -> 1
-						{},       // 0 -> 2
-						{},       // 0 -> 3
-					},
-					{
-						{},  // 1 -> 0
-						nil, // 1 -> 1
-						{},  // 1 -> 2
-						{},  // 1 -> 3
-					},
-					{
-						{},       // 2 -> 0
-						{},       // 2 -> 1
-						nil,      // 2 -> 2
-						{{1, 1}}, // 2 -> 3
-					},
-					{
-						{},  // 3 -> 0
-						{},  // 3 -> 1
-						{},  // 3 -> 2
-						nil, // 3 -> 3
-					},
+			want: [][][]EdgeRatio{
+				{
+					nil,      // 0 -> 0
+					{{0, 1}}, // 0 -> 1
+					{},       // 0 -> 2
+					{},       // 0 -> 3
+				},
+				{
+					{},  // 1 -> 0
+					nil, // 1 -> 1
+					{},  // 1 -> 2
+					{},  // 1 -> 3
+				},
+				{
+					{},       // 2 -> 0
+					{},       // 2 -> 1
+					nil,      // 2 -> 2
+					{{1, 1}}, // 2 -> 3
+				},
+				{
+					{},  // 3 -> 0
+					{},  // 3 -> 1
+					{},  // 3 -> 2
+					nil, // 3 -> 3
 				},
 			},
 		},
@@ -103,43 +673,41 @@ func TestNew(t *testing.T) {
 				{4, 2, 1}, // edge: 3
 				{4, 3, 1}, // edge: 4
 			}, 5),
-			want: &FGraphs{
-				[][][]EdgeRatio{
-					{
-						nil,
-						{},
-						{},
-						{},
-						{},
-					},
-					{
-						{{0, 1}},
-						nil,
-						{},
-						{},
-						{},
-					},
-					{
-						{{0, 1}, {1, 1}},
-						{{1, 1}},
-						nil,
-						{},
-						{},
-					},
-					{
-						{{0, 1}, {2, 1}},
-						{{2, 1}},
-						{},
-						nil,
-						{},
-					},
-					{
-						{{0, 1}, {1, 0.5}, {2, 0.5}, {3, 0.5}, {4, 0.5}},
-						{{1, 0.5}, {2, 0.5}, {3, 0.5}, {4, 0.5}},
-						{{3, 1}},
-						{{4, 1}},
-						nil,
-					},
+			want: [][][]EdgeRatio{
+				{
+					nil,
+					{},
+					{},
+					{},
+					{},
+				},
+				{
+					{{0, 1}},
+					nil,
+					{},
+					{},
+					{},
+				},
+				{
+					{{0, 1}, {1, 1}},
+					{{1, 1}},
+					nil,
+					{},
+					{},
+				},
+				{
+					{{0, 1}, {2, 1}},
+					{{2, 1}},
+					{},
+					nil,
+					{},
+				},
+				{
+					{{0, 1}, {1, 0.5}, {2, 0.5}, {3, 0.5}, {4, 0.5}},
+					{{1, 0.5}, {2, 0.5}, {3, 0.5}, {4, 0.5}},
+					{{3, 1}},
+					{{4, 1}},
+					nil,
 				},
 			},
 		},
@@ -159,32 +727,30 @@ func TestNew(t *testing.T) {
 				{2, 3, 1}, // edge: 6
 				{3, 2, 1}, // edge: 7
 			}, 4),
-			want: &FGraphs{
-				[][][]EdgeRatio{
-					{
-						nil,                                      // 0 -> 0
-						{{0, 1}},                                 // 0 -> 1
-						{{0, 0.5}, {2, 0.5}, {4, 0.5}, {7, 0.5}}, // 0 -> 2
-						{{4, 1}},                                 // 0 -> 3
-					},
-					{
-						{{1, 1}},                                 // 1 -> 0
-						nil,                                      // 1 -> 1
-						{{2, 1}},                                 // 1 -> 2
-						{{1, 0.5}, {2, 0.5}, {4, 0.5}, {6, 0.5}}, // 1 -> 3
-					},
-					{
-						{{1, 0.5}, {3, 0.5}, {5, 0.5}, {6, 0.5}}, // 2 -> 0
-						{{3, 1}},                                 // 2 -> 1
-						nil,                                      // 2 -> 2
-						{{6, 1}},                                 // 2 -> 3
-					},
-					{
-						{{5, 1}},                                 // 3 -> 0
-						{{0, 0.5}, {3, 0.5}, {5, 0.5}, {7, 0.5}}, // 3 -> 1
-						{{7, 1}},                                 // 3 -> 2
-						nil,                                      // 3 -> 3
-					},
+			want: [][][]EdgeRatio{
+				{
+					nil,                                      // 0 -> 0
+					{{0, 1}},                                 // 0 -> 1
+					{{0, 0.5}, {2, 0.5}, {4, 0.5}, {7, 0.5}}, // 0 -> 2
+					{{4, 1}},                                 // 0 -> 3
+				},
+				{
+					{{1, 1}},                                 // 1 -> 0
+					nil,                                      // 1 -> 1
+					{{2, 1}},                                 // 1 -> 2
+					{{1, 0.5}, {2, 0.5}, {4, 0.5}, {6, 0.5}}, // 1 -> 3
+				},
+				{
+					{{1, 0.5}, {3, 0.5}, {5, 0.5}, {6, 0.5}}, // 2 -> 0
+					{{3, 1}},                                 // 2 -> 1
+					nil,                                      // 2 -> 2
+					{{6, 1}},                                 // 2 -> 3
+				},
+				{
+					{{5, 1}},                                 // 3 -> 0
+					{{0, 0.5}, {3, 0.5}, {5, 0.5}, {7, 0.5}}, // 3 -> 1
+					{{7, 1}},                                 // 3 -> 2
+					nil,                                      // 3 -> 3
 				},
 			},
 		},
@@ -200,13 +766,105 @@ func TestNew(t *testing.T) {
 			if !tc.wantErr && gotErr != nil {
 				t.Errorf("New(): want no error, got %s", gotErr)
 			}
-			if diff := cmp.Diff(tc.want.edgesRatios, got.edgesRatios); diff != "" {
+			if diff := cmp.Diff(tc.want, allEdgeRatios(got), cmpopts.EquateEmpty()); diff != "" {
 				t.Errorf("New(): mismatch (-want +got):\n%s", diff)
 			}
 		})
 	}
 }
 
+func TestNew_arenaExactSize(t *testing.T) {
+	graph := gridDigraph(4, 5)
+
+	fgs, err := NewFGraphs(graph)
+	if err != nil {
+		t.Fatalf("NewFGraphs(): want no error, got %s", err)
+	}
+	if got, want := cap(fgs.ratios), len(fgs.ratios); got != want {
+		t.Errorf("NewFGraphs(): want arena capacity %d, got %d", want, got)
+	}
+
+	fgs, err = NewFGraphs(graph, WithCompactRatios())
+	if err != nil {
+		t.Fatalf("NewFGraphs(): want no error, got %s", err)
+	}
+	if got, want := cap(fgs.compactRatios), len(fgs.compactRatios); got != want {
+		t.Errorf("NewFGraphs(WithCompactRatios()): want arena capacity %d, got %d", want, got)
+	}
+}
+
+func TestNew_arenaObjects(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping 300-node instance in short mode")
+	}
+	graph := gridDigraph(15, 20)
+	nNodes := len(graph.Nexts)
+	var before, after runtime.MemStats
+
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	fgs, err := NewFGraphs(graph)
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	if err != nil {
+		t.Fatalf("NewFGraphs(): want no error, got %s", err)
+	}
+	// Number of slices needed to store the ratios as a [][][]EdgeRatio.
+	nestedObjects := int64(1 + nNodes + nNodes*nNodes)
+	gotObjects := int64(after.HeapObjects) - int64(before.HeapObjects)
+	if 2*gotObjects > nestedObjects {
+		t.Errorf("NewFGraphs(): want at most %d retained objects, got %d", nestedObjects/2, gotObjects)
+	}
+	runtime.KeepAlive(fgs)
+}
+
+func BenchmarkNewFGraphs(b *testing.B) {
+	graph := gridDigraph(15, 20)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := NewFGraphs(graph); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// allEdgeRatios returns the edge ratios of all the forwarding graphs indexed by
+// source and destination nodes.
+func allEdgeRatios(fgs *FGraphs) [][][]EdgeRatio {
+	ratios := make([][][]EdgeRatio, fgs.nNodes)
+	for s := range ratios {
+		ratios[s] = make([][]EdgeRatio, fgs.nNodes)
+		for t := range ratios[s] {
+			ratios[s][t] = fgs.EdgeRatios(s, t)
+		}
+	}
+	return ratios
+}
+
+// gridDigraph returns a rows x cols grid where each node is connected to its
+// horizontal and vertical neighbors in both directions. Costs are in [1, 3]
+// so that the graph has both unique and equal-cost shortest paths.
+func gridDigraph(rows int, cols int) *Digraph {
+	edges := []Edge{}
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			u := r*cols + c
+			if c+1 < cols {
+				cost := 1 + (u % 3)
+				edges = append(edges, Edge{u, u + 1, cost}, Edge{u + 1, u, cost})
+			}
+			if r+1 < rows {
+				cost := 1 + ((u + 1) % 3)
+				edges = append(edges, Edge{u, u + cols, cost}, Edge{u + cols, u, cost})
+			}
+		}
+	}
+	return NewDigraph(edges, rows*cols)
+}
+
 func TestNew_shortestPathDAG(t *testing.T) {
 	testCases := []struct {
 		desc    string
@@ -308,7 +966,7 @@ func TestNew_shortestPathDAG(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
-			got, gotErr := shortestDAG(tc.graph, tc.src)
+			got, _, gotErr := shortestDAG(tc.graph, tc.src)
 
 			if tc.wantErr && gotErr == nil {
 				t.Errorf("shortestDAG(): want error, got nil")
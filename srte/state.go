@@ -1,6 +1,11 @@
 package srte
 
-import "math"
+import (
+	"fmt"
+	"math"
+	"runtime/debug"
+	"sort"
+)
 
 // LoadChange is a pair that contains the load of an edge before it was changed.
 type LoadChange struct {
@@ -14,7 +19,9 @@ type LoadChange struct {
 type NetworkState struct {
 	loads []int64
 
-	// Stack of changes used to restore the last persisted state.
+	// Stack of changes used to restore the last persisted state. An edge is
+	// recorded at most once per persisted state (see savedAt) which means that
+	// the stack never holds more than nEdges changes and never has to grow.
 	changes  []LoadChange
 	nChanges int
 
@@ -25,17 +32,149 @@ type NetworkState struct {
 	// way to mark all edges as unchanged in O(1) by incrementing the timestamp.
 	savedAt   []uint
 	timestamp uint
+
+	// Checkpoints are implemented with a second stack of changes, the journal,
+	// which records the load of each edge before its first change following
+	// the most recent checkpoint. Unlike the changes stack, an edge can appear
+	// several times in the journal (once per checkpoint level in which it was
+	// changed). The journaledAt and level fields play the same role as savedAt
+	// and timestamp but for the current checkpoint level. Because of nesting,
+	// the journal can hold more than nEdges changes and thus grows as needed.
+	journal     []LoadChange
+	checkpoints []checkpoint
+	journaledAt []uint
+	level       uint
+
+	// Generation of the checkpoints, incremented each time checkpoints are
+	// discarded. A token is only valid if its generation matches the one of
+	// the checkpoint at its index, which prevents discarded tokens from being
+	// confused with checkpoints created later at the same index.
+	generation uint
+
+	// Highest persisted load of each edge, nil if watermarks are disabled.
+	maxLoads []int64
+
+	// Load of each edge broken down by class, nil if classes are disabled.
+	// Class 0 is implicit: its load is the load of the edge minus the load of
+	// the other classes, which keeps AddLoad free of class bookkeeping. The
+	// load of class c > 0 on edge e is at index e*(nClasses-1) + c-1. The
+	// saved class loads of the i-th change (resp. journal entry) are stored
+	// at the same place as the class loads of the i-th edge but in
+	// savedClassLoads (resp. in journalClassLoads).
+	nClasses          int
+	classLoads        []int64
+	savedClassLoads   []int64
+	journalClassLoads []int64
+
+	// Debug checks performed by AddLoad. The checks field is true if any of
+	// the checks is enabled.
+	checks        bool
+	checkOverflow bool
+	checkBounds   bool
+	ceiling       int64 // no ceiling if <= 0
+
+	// True if AddLoad must always take its slow path (see addLoadSlow), i.e.
+	// if debug checks or classes are enabled or if there are outstanding
+	// checkpoints.
+	slow bool
+}
+
+// StateOption configures optional behaviors of a NetworkState.
+type StateOption func(*NetworkState)
+
+// WithWatermarks enables the tracking of the maximum load reached by each edge
+// in persisted states (see MaxLoadSeen).
+func WithWatermarks() StateOption {
+	return func(s *NetworkState) {
+		s.maxLoads = make([]int64, len(s.loads))
+	}
+}
+
+// WithClasses enables the tracking of the load of each edge broken down into n
+// classes (e.g. priority classes) numbered from 0 to n-1. Class loads are
+// changed with AddClassLoad and RemoveClassLoad; AddLoad and RemoveLoad change
+// the load of class 0. The load of an edge (see Load) is always the sum of its
+// class loads. Class loads are restored with the rest of the state by
+// UndoChanges and RollbackTo.
+//
+// WithClasses panics if n is not positive.
+func WithClasses(n int) StateOption {
+	if n <= 0 {
+		panic(fmt.Sprintf("invalid number of classes %d", n))
+	}
+	return func(s *NetworkState) {
+		s.nClasses = n
+		s.classLoads = make([]int64, len(s.loads)*(n-1))
+		s.savedClassLoads = make([]int64, len(s.loads)*(n-1))
+	}
+}
+
+// WithOverflowCheck makes AddLoad (and RemoveLoad) panic if the resulting load
+// of an edge would overflow int64. This is meant to be used for debugging as
+// it adds a check on every load change.
+func WithOverflowCheck() StateOption {
+	return func(s *NetworkState) {
+		s.checks = true
+		s.checkOverflow = true
+	}
+}
+
+// WithLoadCheck makes AddLoad (and RemoveLoad) panic with a *LoadError if the
+// resulting load of an edge is negative or greater than ceiling. A ceiling of
+// 0 or less means that loads are not bounded from above. This is meant to be
+// used for debugging as it adds a check on every load change. The ceiling is
+// also used by Validate.
+func WithLoadCheck(ceiling int64) StateOption {
+	return func(s *NetworkState) {
+		s.checks = true
+		s.checkBounds = true
+		s.ceiling = ceiling
+	}
+}
+
+// LoadError reports an invalid load on an edge.
+type LoadError struct {
+	Edge   int
+	Reason string
+
+	// Stack trace of the goroutine that made the invalid change, nil if the
+	// error was not reported by AddLoad.
+	Stack []byte
+}
+
+func (e *LoadError) Error() string {
+	return fmt.Sprintf("edge %d: %s", e.Edge, e.Reason)
+}
+
+// Checkpoint identifies a checkpoint created with NetworkState.Checkpoint.
+type Checkpoint struct {
+	generation uint
+	index      int
+}
+
+// checkpoint contains the size of the journal and of the changes stack at the
+// time a checkpoint was created, as well as the generation of its token.
+type checkpoint struct {
+	nJournal   int
+	nChanges   int
+	generation uint
 }
 
 // NewNetworkState initializes and returns a new NetworkState.
-func NewNetworkState(nEdges int) *NetworkState {
-	return &NetworkState{
+func NewNetworkState(nEdges int, opts ...StateOption) *NetworkState {
+	s := &NetworkState{
 		loads:     make([]int64, nEdges),
 		changes:   make([]LoadChange, nEdges),
 		nChanges:  0,
 		savedAt:   make([]uint, nEdges),
 		timestamp: 1, // must be greater than the zero values in savedAt
+		level:     1, // must be greater than the zero values in journaledAt
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.updateSlow()
+	return s
 }
 
 // Load returns the current load on the edge.
@@ -43,13 +182,38 @@ func (s *NetworkState) Load(edge int) int64 {
 	return s.loads[edge]
 }
 
+// ClassLoad returns the current load of the class on the edge.
+//
+// ClassLoad panics if the state was not created with WithClasses.
+func (s *NetworkState) ClassLoad(edge int, class int) int64 {
+	if s.classLoads == nil {
+		panic("classes are not enabled")
+	}
+	if class != 0 {
+		return s.edgeClassLoads(edge)[class-1]
+	}
+	l := s.loads[edge]
+	for _, cl := range s.edgeClassLoads(edge) {
+		l -= cl
+	}
+	return l
+}
+
+// NumClasses returns the number of classes set with WithClasses, or 0 if
+// classes are disabled.
+func (s *NetworkState) NumClasses() int {
+	return s.nClasses
+}
+
 // AddLoad adds the load from the edge. The change is registered so that it
-// can be undone if needed.
+// can be undone if needed. If classes are enabled, the load is added to class
+// 0 (see WithClasses).
 func (s *NetworkState) AddLoad(edge int, load int64) {
-	if s.savedAt[edge] != s.timestamp {
-		s.changes[s.nChanges] = LoadChange{edge, s.loads[edge]}
-		s.nChanges += 1
-		s.savedAt[edge] = s.timestamp
+	// Keep this function small enough to be inlined. Anything other than adding
+	// load to an edge that was already changed belongs to addLoadSlow.
+	if s.slow || s.savedAt[edge] != s.timestamp {
+		s.addLoadSlow(edge, load)
+		return
 	}
 	s.loads[edge] += load
 }
@@ -60,10 +224,41 @@ func (s *NetworkState) RemoveLoad(edge int, load int64) {
 	s.AddLoad(edge, -load)
 }
 
+// AddClassLoad adds the load of the class to the edge. The load of the edge
+// (see Load) is changed accordingly. The change is registered so that it can
+// be undone if needed. Debug checks (e.g. WithLoadCheck) apply to the load of
+// the edge, not to the load of the class.
+//
+// AddClassLoad panics if the state was not created with WithClasses.
+func (s *NetworkState) AddClassLoad(edge int, class int, load int64) {
+	if s.classLoads == nil {
+		panic("classes are not enabled")
+	}
+	if class < 0 || s.nClasses <= class {
+		panic(fmt.Sprintf("class %d is not in [0, %d)", class, s.nClasses))
+	}
+	s.AddLoad(edge, load) // also saves the class loads if needed
+	if class != 0 {
+		s.edgeClassLoads(edge)[class-1] += load
+	}
+}
+
+// RemoveClassLoad removes the load of the class from the edge. The change is
+// registered so that it can be undone if needed.
+//
+// RemoveClassLoad panics if the state was not created with WithClasses.
+func (s *NetworkState) RemoveClassLoad(edge int, class int, load int64) {
+	s.AddClassLoad(edge, class, -load)
+}
+
 // PersistChanges persists all the changes as the "new" state. New changes can
 // be accumulated (and undone) from this point.
 func (s *NetworkState) PersistChanges() {
+	if s.maxLoads != nil {
+		s.ForEachChange(s.updateWatermark)
+	}
 	s.nChanges = 0
+	s.clearCheckpoints()
 	s.incrTimestamp()
 }
 
@@ -75,12 +270,91 @@ func (s *NetworkState) UndoChanges() {
 		s.nChanges -= 1
 		lc := s.changes[s.nChanges]
 		s.loads[lc.Edge] = lc.SavedLoad
+		if s.classLoads != nil {
+			i := s.nChanges * (s.nClasses - 1)
+			copy(s.edgeClassLoads(lc.Edge), s.savedClassLoads[i:])
+		}
 	}
+	s.clearCheckpoints()
 	s.incrTimestamp()
 }
 
+// Checkpoint creates a new checkpoint and returns a token that can be used to
+// undo all the changes made after it with RollbackTo. Checkpoints can be
+// nested. All the outstanding checkpoints are discarded (and their tokens
+// invalidated) when changes are either persisted or undone.
+func (s *NetworkState) Checkpoint() Checkpoint {
+	if s.journaledAt == nil {
+		s.journal = make([]LoadChange, 0, len(s.loads))
+		s.journaledAt = make([]uint, len(s.loads))
+		if s.classLoads != nil {
+			s.journalClassLoads = make([]int64, 0, len(s.loads)*(s.nClasses-1))
+		}
+	}
+	s.checkpoints = append(s.checkpoints, checkpoint{
+		nJournal:   len(s.journal),
+		nChanges:   s.nChanges,
+		generation: s.generation,
+	})
+	s.slow = true
+	s.incrLevel()
+	return Checkpoint{
+		generation: s.generation,
+		index:      len(s.checkpoints) - 1,
+	}
+}
+
+// RollbackTo undoes all the changes made since checkpoint cp was created. The
+// checkpoint and all the checkpoints created after it are discarded. Changes
+// made before cp are kept and can still be persisted or undone. This operation
+// is done in O(C) where C is the number of edge changes recorded since cp.
+//
+// RollbackTo panics if cp is not an outstanding checkpoint.
+func (s *NetworkState) RollbackTo(cp Checkpoint) {
+	if !s.isOutstanding(cp) {
+		panic(fmt.Sprintf("checkpoint %d (generation %d) is not outstanding", cp.index, cp.generation))
+	}
+	c := s.checkpoints[cp.index]
+	for i := len(s.journal) - 1; i >= c.nJournal; i-- {
+		lc := s.journal[i]
+		s.loads[lc.Edge] = lc.SavedLoad
+		if s.classLoads != nil {
+			copy(s.edgeClassLoads(lc.Edge), s.journalClassLoads[i*(s.nClasses-1):])
+		}
+	}
+	s.journal = s.journal[:c.nJournal]
+	if s.classLoads != nil {
+		s.journalClassLoads = s.journalClassLoads[:c.nJournal*(s.nClasses-1)]
+	}
+
+	// Edges that were changed for the first time after the checkpoint are
+	// back to their persisted load and are thus not changed anymore.
+	for s.nChanges > c.nChanges {
+		s.nChanges -= 1
+		s.savedAt[s.changes[s.nChanges].Edge] = 0
+	}
+
+	s.checkpoints = s.checkpoints[:cp.index]
+	s.generation += 1
+	s.updateSlow()
+	s.incrLevel()
+}
+
+// isOutstanding returns true if cp is the token of an outstanding checkpoint.
+func (s *NetworkState) isOutstanding(cp Checkpoint) bool {
+	if cp.index < 0 || len(s.checkpoints) <= cp.index {
+		return false
+	}
+	return s.checkpoints[cp.index].generation == cp.generation
+}
+
 // Changes returns the edges that have been changed since the last time
-// changes were persisted.
+// changes were persisted. Each changed edge appears exactly once, no matter
+// how many times its load was changed, with its load in the last persisted
+// state as SavedLoad. Edges appear in the order in which they were first
+// changed. Note that an edge whose load was changed and then brought back to
+// its persisted value (e.g. by adding and removing the same load) is still
+// considered changed, unless the change was rolled back with RollbackTo.
 //
 // Important: the slice is a view on one of the state's internal structure and
 // should only be used in read-only operations. Modifying the slice will most
@@ -89,15 +363,282 @@ func (s *NetworkState) Changes() []LoadChange {
 	return s.changes[:s.nChanges]
 }
 
+// ChangesSorted returns a copy of the changes (see Changes) sorted by edge.
+func (s *NetworkState) ChangesSorted() []LoadChange {
+	changes := make([]LoadChange, s.nChanges)
+	copy(changes, s.changes[:s.nChanges])
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Edge < changes[j].Edge
+	})
+	return changes
+}
+
+// ForEachChange calls fn for each change (see Changes) in the order in which
+// edges were first changed. The function must not modify the state.
+func (s *NetworkState) ForEachChange(fn func(LoadChange)) {
+	for _, lc := range s.changes[:s.nChanges] {
+		fn(lc)
+	}
+}
+
+// Validate checks the load of every edge and returns an error for each edge
+// whose load is negative or greater than the ceiling set with WithLoadCheck
+// (if any). It returns nil if all the loads are valid.
+func (s *NetworkState) Validate() []error {
+	var errs []error
+	for e, l := range s.loads {
+		if err := s.checkLoad(e, l); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// ChangesCap returns the number of changes that the state can record without
+// having to allocate memory, including the changes recorded for checkpoints.
+// This is meant to be used for diagnostics.
+func (s *NetworkState) ChangesCap() int {
+	return cap(s.changes) + cap(s.journal)
+}
+
+// MaxLoadSeen returns the maximum load of the edge over all the persisted
+// states since the state was created or the watermarks were last reset. Loads
+// that were undone or not persisted yet are not taken into account.
+//
+// MaxLoadSeen panics if the state was not created with WithWatermarks.
+func (s *NetworkState) MaxLoadSeen(edge int) int64 {
+	if s.maxLoads == nil {
+		panic("watermarks are not enabled")
+	}
+	return s.maxLoads[edge]
+}
+
+// ResetWatermarks resets the maximum load seen on each edge to its load in the
+// last persisted state.
+//
+// ResetWatermarks panics if the state was not created with WithWatermarks.
+func (s *NetworkState) ResetWatermarks() {
+	if s.maxLoads == nil {
+		panic("watermarks are not enabled")
+	}
+	copy(s.maxLoads, s.loads)
+	s.ForEachChange(func(lc LoadChange) {
+		s.maxLoads[lc.Edge] = lc.SavedLoad
+	})
+}
+
+// Clone returns a deep copy of the state. The clone does not share any memory
+// with s and is created with the same options. The loads of the clone are the
+// current loads of s, including its changes that have not been persisted yet,
+// which are thus considered persisted in the clone (and accounted for in its
+// watermarks). The clone has no pending changes and no checkpoints.
+func (s *NetworkState) Clone() *NetworkState {
+	nEdges := len(s.loads)
+	c := &NetworkState{
+		loads:         make([]int64, nEdges),
+		changes:       make([]LoadChange, nEdges),
+		nChanges:      0,
+		savedAt:       make([]uint, nEdges),
+		timestamp:     1,
+		level:         1,
+		checks:        s.checks,
+		checkOverflow: s.checkOverflow,
+		checkBounds:   s.checkBounds,
+		ceiling:       s.ceiling,
+		slow:          s.slow,
+	}
+	copy(c.loads, s.loads)
+	if s.classLoads != nil {
+		c.nClasses = s.nClasses
+		c.classLoads = make([]int64, len(s.classLoads))
+		c.savedClassLoads = make([]int64, len(s.classLoads))
+		copy(c.classLoads, s.classLoads)
+	}
+	if s.maxLoads != nil {
+		c.maxLoads = make([]int64, nEdges)
+		copy(c.maxLoads, s.maxLoads)
+		s.ForEachChange(c.updateWatermark)
+	}
+	return c
+}
+
+// Snapshot is an immutable copy of the loads of a NetworkState.
+type Snapshot struct {
+	loads []int64
+}
+
+// Load returns the load of the edge at the time the snapshot was taken.
+func (sn Snapshot) Load(edge int) int64 {
+	return sn.loads[edge]
+}
+
+// NumEdges returns the number of edges in the snapshot.
+func (sn Snapshot) NumEdges() int {
+	return len(sn.loads)
+}
+
+// Snapshot returns a copy of the current loads. Note that the snapshot sees
+// the changes that have not been persisted yet.
+func (s *NetworkState) Snapshot() Snapshot {
+	loads := make([]int64, len(s.loads))
+	copy(loads, s.loads)
+	return Snapshot{loads: loads}
+}
+
+// Diff returns the edges whose current load differs from their load in the
+// snapshot, in increasing order of edge. The SavedLoad of each LoadChange is
+// the load of the edge in the snapshot. As with Snapshot, the current loads
+// include the changes that have not been persisted yet. Diff returns nil (and
+// does not allocate) if there is no difference.
+//
+// Diff panics if the snapshot and the state do not have the same number of
+// edges.
+func (s *NetworkState) Diff(sn Snapshot) []LoadChange {
+	if len(sn.loads) != len(s.loads) {
+		panic(fmt.Sprintf("snapshot has %d edges, want %d", len(sn.loads), len(s.loads)))
+	}
+	var diff []LoadChange
+	for e, l := range sn.loads {
+		if s.loads[e] != l {
+			diff = append(diff, LoadChange{e, l})
+		}
+	}
+	return diff
+}
+
+// addLoadSlow is the outlined part of AddLoad. It records the first change of
+// an edge in the current state and implements the optional behaviors of the
+// state (see updateSlow). The default case is handled first as it is, by far,
+// the most frequent one.
+func (s *NetworkState) addLoadSlow(edge int, load int64) {
+	if !s.slow {
+		s.changes[s.nChanges] = LoadChange{edge, s.loads[edge]}
+		s.nChanges += 1
+		s.savedAt[edge] = s.timestamp
+		s.loads[edge] += load
+		return
+	}
+	if s.checks {
+		s.checkAdd(edge, load)
+	}
+	if s.savedAt[edge] != s.timestamp {
+		s.changes[s.nChanges] = LoadChange{edge, s.loads[edge]}
+		if s.classLoads != nil {
+			s.saveClassLoads(edge)
+		}
+		s.nChanges += 1
+		s.savedAt[edge] = s.timestamp
+	}
+	if len(s.checkpoints) > 0 && s.journaledAt[edge] != s.level {
+		s.journal = append(s.journal, LoadChange{edge, s.loads[edge]})
+		if s.classLoads != nil {
+			s.journalClassLoads = append(s.journalClassLoads, s.edgeClassLoads(edge)...)
+		}
+		s.journaledAt[edge] = s.level
+	}
+	s.loads[edge] += load
+}
+
+// updateSlow updates whether AddLoad must always take its slow path.
+func (s *NetworkState) updateSlow() {
+	s.slow = s.checks || s.classLoads != nil || len(s.checkpoints) > 0
+}
+
+// updateWatermark updates the maximum load seen on the changed edge with its
+// current load.
+func (s *NetworkState) updateWatermark(lc LoadChange) {
+	if l := s.loads[lc.Edge]; l > s.maxLoads[lc.Edge] {
+		s.maxLoads[lc.Edge] = l
+	}
+}
+
+// saveClassLoads saves the class loads of the edge for the change at the top
+// of the changes stack.
+func (s *NetworkState) saveClassLoads(edge int) {
+	copy(s.savedClassLoads[s.nChanges*(s.nClasses-1):], s.edgeClassLoads(edge))
+}
+
+// edgeClassLoads returns the explicit class loads (i.e. of classes 1 to
+// nClasses-1) of the edge as a view on classLoads.
+func (s *NetworkState) edgeClassLoads(edge int) []int64 {
+	n := s.nClasses - 1
+	return s.classLoads[edge*n : (edge+1)*n]
+}
+
+// checkAdd panics if adding load to the edge violates one of the enabled debug
+// checks. The state is left unchanged in that case.
+func (s *NetworkState) checkAdd(edge int, load int64) {
+	l := s.loads[edge]
+	if s.checkOverflow && addOverflows(l, load) {
+		panic(&LoadError{
+			Edge:   edge,
+			Reason: fmt.Sprintf("load overflow (%d + %d)", l, load),
+			Stack:  debug.Stack(),
+		})
+	}
+	if !s.checkBounds {
+		return
+	}
+	if err := s.checkLoad(edge, l+load); err != nil {
+		err.Stack = debug.Stack()
+		panic(err)
+	}
+}
+
+// checkLoad returns an error if load is not a valid load for the edge.
+func (s *NetworkState) checkLoad(edge int, load int64) *LoadError {
+	if load < 0 {
+		return &LoadError{
+			Edge:   edge,
+			Reason: fmt.Sprintf("negative load %d", load),
+		}
+	}
+	if s.ceiling > 0 && load > s.ceiling {
+		return &LoadError{
+			Edge:   edge,
+			Reason: fmt.Sprintf("load %d exceeds ceiling %d", load, s.ceiling),
+		}
+	}
+	return nil
+}
+
+// addOverflows returns true if a + b overflows int64.
+func addOverflows(a int64, b int64) bool {
+	if b > 0 {
+		return a > math.MaxInt64-b
+	}
+	return a < math.MinInt64-b
+}
+
+// clearCheckpoints discards all the outstanding checkpoints.
+func (s *NetworkState) clearCheckpoints() {
+	s.journal = s.journal[:0]
+	s.journalClassLoads = s.journalClassLoads[:0]
+	s.checkpoints = s.checkpoints[:0]
+	s.generation += 1
+	s.updateSlow()
+}
+
 // incrTimestamp safely increments the value of the timestamp by resetting the
 // savedAt slice and the timestamp if it overflows.
 func (s *NetworkState) incrTimestamp() {
-	if s.timestamp != math.MaxUint {
-		s.timestamp += 1
-		return
+	s.timestamp = nextStamp(s.timestamp, s.savedAt)
+}
+
+// incrLevel safely increments the value of the checkpoint level by resetting
+// the journaledAt slice and the level if it overflows.
+func (s *NetworkState) incrLevel() {
+	s.level = nextStamp(s.level, s.journaledAt)
+}
+
+// nextStamp returns the logical timestamp that follows stamp. If stamp would
+// overflow, all the marks are reset to 0 and the returned timestamp is 1.
+func nextStamp(stamp uint, marks []uint) uint {
+	if stamp != math.MaxUint {
+		return stamp + 1
 	}
-	s.timestamp = 1
-	for i := range s.savedAt {
-		s.savedAt[i] = 0
+	for i := range marks {
+		marks[i] = 0
 	}
+	return 1
 }
@@ -1,7 +1,11 @@
 package srte
 
 import (
+	"bytes"
+	"errors"
 	"math"
+	"math/rand"
+	"os/exec"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -154,7 +158,7 @@ func TestNetworkState_Changes(t *testing.T) {
 
 func TestNetworkState_incrTimestamp(t *testing.T) {
 	state := NewNetworkState(5)
-	state.timestamp = math.MaxInt
+	state.timestamp = math.MaxUint
 
 	state.incrTimestamp() // overflow
 
@@ -167,3 +171,882 @@ func TestNetworkState_incrTimestamp(t *testing.T) {
 		}
 	}
 }
+
+func TestNetworkState_RollbackTo(t *testing.T) {
+	wantChanges := []LoadChange{{0, 0}, {1, 10}}
+	wantLoads := []int64{5, 30, 0, 0}
+	state := NewNetworkState(4)
+	state.loads[1] = 10
+
+	state.AddLoad(0, 5)
+	state.AddLoad(1, 20)
+	cp := state.Checkpoint()
+	state.AddLoad(1, 100)
+	state.RemoveLoad(0, 5)
+	state.AddLoad(2, 7)
+	state.RollbackTo(cp)
+	gotChanges := state.Changes()
+
+	for e, want := range wantLoads {
+		if got := state.Load(e); got != want {
+			t.Errorf("Load(%d): want %d, got %d", e, want, got)
+		}
+	}
+	if diff := cmp.Diff(wantChanges, gotChanges); diff != "" {
+		t.Errorf("Changes(): mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNetworkState_RollbackTo_nested(t *testing.T) {
+	state := NewNetworkState(4)
+	state.loads[0] = 100
+
+	state.RemoveLoad(0, 10) // 90
+	cp1 := state.Checkpoint()
+	state.AddLoad(1, 10)
+	state.RemoveLoad(0, 20) // 70
+	cp2 := state.Checkpoint()
+	state.RemoveLoad(0, 30) // 40
+	state.AddLoad(1, 5)
+	state.AddLoad(2, 1)
+	state.AddLoad(0, 1) // 41
+
+	state.RollbackTo(cp2)
+
+	for e, want := range []int64{70, 10, 0, 0} {
+		if got := state.Load(e); got != want {
+			t.Errorf("RollbackTo(cp2): Load(%d): want %d, got %d", e, want, got)
+		}
+	}
+	want := []LoadChange{{0, 100}, {1, 0}}
+	if diff := cmp.Diff(want, state.Changes()); diff != "" {
+		t.Errorf("RollbackTo(cp2): Changes() mismatch (-want +got):\n%s", diff)
+	}
+
+	// Changes made after rolling back to cp2 belong to cp1's level.
+	state.AddLoad(3, 3)
+	state.RemoveLoad(0, 50) // 20
+	state.RollbackTo(cp1)
+
+	for e, want := range []int64{90, 0, 0, 0} {
+		if got := state.Load(e); got != want {
+			t.Errorf("RollbackTo(cp1): Load(%d): want %d, got %d", e, want, got)
+		}
+	}
+	want = []LoadChange{{0, 100}}
+	if diff := cmp.Diff(want, state.Changes()); diff != "" {
+		t.Errorf("RollbackTo(cp1): Changes() mismatch (-want +got):\n%s", diff)
+	}
+
+	state.UndoChanges()
+
+	for e, want := range []int64{100, 0, 0, 0} {
+		if got := state.Load(e); got != want {
+			t.Errorf("UndoChanges(): Load(%d): want %d, got %d", e, want, got)
+		}
+	}
+}
+
+func TestNetworkState_PersistChanges_checkpoints(t *testing.T) {
+	wantLoads := []int64{10, 20, 0}
+	state := NewNetworkState(3)
+
+	state.AddLoad(0, 10)
+	state.Checkpoint()
+	state.AddLoad(1, 20)
+	state.Checkpoint()
+	state.PersistChanges()
+	state.AddLoad(2, 30)
+	state.UndoChanges()
+
+	for e, want := range wantLoads {
+		if got := state.Load(e); got != want {
+			t.Errorf("Load(%d): want %d, got %d", e, want, got)
+		}
+	}
+	if got := len(state.checkpoints); got != 0 {
+		t.Errorf("checkpoints: want 0, got %d", got)
+	}
+}
+
+func TestNetworkState_RollbackTo_invalid(t *testing.T) {
+	testCases := []struct {
+		desc string
+		// invalidToken returns a token that is not outstanding anymore.
+		invalidToken func(state *NetworkState) Checkpoint
+	}{
+		{
+			desc: "persisted",
+			invalidToken: func(state *NetworkState) Checkpoint {
+				cp := state.Checkpoint()
+				state.PersistChanges()
+				return cp
+			},
+		},
+		{
+			desc: "persisted and reused",
+			invalidToken: func(state *NetworkState) Checkpoint {
+				cp := state.Checkpoint()
+				state.AddLoad(0, 1)
+				state.PersistChanges()
+				state.Checkpoint()
+				state.AddLoad(1, 1)
+				return cp
+			},
+		},
+		{
+			desc: "undone and reused",
+			invalidToken: func(state *NetworkState) Checkpoint {
+				cp := state.Checkpoint()
+				state.AddLoad(0, 1)
+				state.UndoChanges()
+				state.Checkpoint()
+				return cp
+			},
+		},
+		{
+			desc: "rolled back and reused",
+			invalidToken: func(state *NetworkState) Checkpoint {
+				state.Checkpoint()
+				cp := state.Checkpoint()
+				state.AddLoad(0, 1)
+				state.RollbackTo(cp)
+				state.Checkpoint()
+				state.AddLoad(1, 1)
+				return cp
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			state := NewNetworkState(3)
+			cp := tc.invalidToken(state)
+
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RollbackTo(): want panic, got none")
+				}
+			}()
+
+			state.RollbackTo(cp)
+		})
+	}
+}
+
+func TestNetworkState_RollbackTo_afterRollback(t *testing.T) {
+	state := NewNetworkState(2)
+	cp1 := state.Checkpoint()
+	state.AddLoad(0, 1)
+	cp2 := state.Checkpoint()
+	state.AddLoad(1, 2)
+	state.RollbackTo(cp2)
+	state.Checkpoint()
+	state.AddLoad(1, 3)
+
+	// Checkpoints created before a rolled back checkpoint remain valid.
+	state.RollbackTo(cp1)
+
+	if diff := cmp.Diff([]int64{0, 0}, state.loads); diff != "" {
+		t.Errorf("RollbackTo(cp1): mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNetworkState_Snapshot(t *testing.T) {
+	want := []int64{10, 20, 30}
+	state := NewNetworkState(3)
+	state.AddLoad(0, 10)
+	state.AddLoad(1, 20)
+	state.PersistChanges()
+	state.AddLoad(2, 30) // pending changes are part of the snapshot
+
+	sn := state.Snapshot()
+	state.UndoChanges()
+	state.AddLoad(0, 100)
+
+	if got := sn.NumEdges(); got != len(want) {
+		t.Errorf("NumEdges(): want %d, got %d", len(want), got)
+	}
+	for e, w := range want {
+		if got := sn.Load(e); got != w {
+			t.Errorf("Load(%d): want %d, got %d", e, w, got)
+		}
+	}
+}
+
+func TestNetworkState_Diff(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		change func(*NetworkState)
+		want   []LoadChange
+	}{
+		{
+			desc:   "identical states",
+			change: func(s *NetworkState) {},
+			want:   nil,
+		},
+		{
+			desc: "changes cancel out",
+			change: func(s *NetworkState) {
+				s.AddLoad(1, 10)
+				s.RemoveLoad(1, 10)
+			},
+			want: nil,
+		},
+		{
+			desc: "pending changes",
+			change: func(s *NetworkState) {
+				s.RemoveLoad(3, 5)
+				s.AddLoad(1, 10)
+			},
+			want: []LoadChange{{1, 10}, {3, 30}},
+		},
+		{
+			desc: "persisted changes",
+			change: func(s *NetworkState) {
+				s.AddLoad(0, 1)
+				s.PersistChanges()
+			},
+			want: []LoadChange{{0, 0}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			state := NewNetworkState(4)
+			state.loads = []int64{0, 10, 20, 30}
+			sn := state.Snapshot()
+
+			tc.change(state)
+			got := state.Diff(sn)
+
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Diff(): mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNetworkState_Diff_random(t *testing.T) {
+	nEdges := 10000
+	rng := rand.New(rand.NewSource(42))
+	state := NewNetworkState(nEdges)
+	for e := 0; e < nEdges; e++ {
+		state.AddLoad(e, rng.Int63n(1000))
+	}
+	state.PersistChanges()
+	sn := state.Snapshot()
+
+	want := []LoadChange{}
+	for e := 0; e < nEdges; e++ {
+		if rng.Intn(10) != 0 {
+			continue
+		}
+		want = append(want, LoadChange{e, state.Load(e)})
+		state.AddLoad(e, 1+rng.Int63n(1000))
+	}
+	got := state.Diff(sn)
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Diff(): mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNetworkState_Diff_noAlloc(t *testing.T) {
+	state := NewNetworkState(100)
+	sn := state.Snapshot()
+
+	allocs := testing.AllocsPerRun(10, func() {
+		state.Diff(sn)
+	})
+
+	if allocs != 0 {
+		t.Errorf("Diff(): want 0 allocations, got %f", allocs)
+	}
+}
+
+func TestNetworkState_MaxLoadSeen(t *testing.T) {
+	wantMaxLoads := []int64{50, 30, 0}
+	state := NewNetworkState(3, WithWatermarks())
+
+	state.AddLoad(0, 50)
+	state.AddLoad(1, 30)
+	state.PersistChanges()
+	state.RemoveLoad(0, 40)
+	state.RemoveLoad(1, 10)
+	state.PersistChanges()
+	state.AddLoad(2, 100) // transient spike
+	state.UndoChanges()
+	state.AddLoad(1, 1000) // transient spike
+	state.RemoveLoad(1, 1000)
+	state.PersistChanges()
+	state.AddLoad(2, 100) // not persisted yet
+
+	for e, want := range wantMaxLoads {
+		if got := state.MaxLoadSeen(e); got != want {
+			t.Errorf("MaxLoadSeen(%d): want %d, got %d", e, want, got)
+		}
+	}
+}
+
+func TestNetworkState_ResetWatermarks(t *testing.T) {
+	wantMaxLoads := []int64{10, 20, 0}
+	state := NewNetworkState(3, WithWatermarks())
+
+	state.AddLoad(0, 50)
+	state.AddLoad(1, 20)
+	state.PersistChanges()
+	state.RemoveLoad(0, 40)
+	state.PersistChanges()
+	state.AddLoad(2, 10) // not persisted yet
+	state.ResetWatermarks()
+
+	for e, want := range wantMaxLoads {
+		if got := state.MaxLoadSeen(e); got != want {
+			t.Errorf("MaxLoadSeen(%d): want %d, got %d", e, want, got)
+		}
+	}
+}
+
+func TestNetworkState_MaxLoadSeen_disabled(t *testing.T) {
+	state := NewNetworkState(3)
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("MaxLoadSeen(): want panic, got none")
+		}
+	}()
+
+	state.MaxLoadSeen(0)
+}
+
+func TestNetworkState_AddLoad_overflowCheck(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		load      int64
+		add       int64
+		wantPanic bool
+	}{
+		{
+			desc: "no overflow",
+			load: math.MaxInt64 - 10,
+			add:  10,
+		},
+		{
+			desc:      "positive overflow",
+			load:      math.MaxInt64 - 10,
+			add:       11,
+			wantPanic: true,
+		},
+		{
+			desc: "no negative overflow",
+			load: math.MinInt64 + 10,
+			add:  -10,
+		},
+		{
+			desc:      "negative overflow",
+			load:      math.MinInt64 + 10,
+			add:       -11,
+			wantPanic: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			state := NewNetworkState(1, WithOverflowCheck())
+			state.loads[0] = tc.load
+
+			defer func() {
+				if gotPanic := recover() != nil; gotPanic != tc.wantPanic {
+					t.Errorf("AddLoad(): want panic %t, got %t", tc.wantPanic, gotPanic)
+				}
+				if tc.wantPanic && state.Load(0) != tc.load {
+					t.Errorf("Load(0): want %d, got %d", tc.load, state.Load(0))
+				}
+			}()
+
+			state.AddLoad(0, tc.add)
+		})
+	}
+}
+
+func TestNetworkState_AddLoad_noOverflowCheck(t *testing.T) {
+	state := NewNetworkState(1)
+	state.loads[0] = math.MaxInt64
+
+	state.AddLoad(0, 1) // wraps around silently
+
+	if got := state.Load(0); got != math.MinInt64 {
+		t.Errorf("Load(0): want %d, got %d", int64(math.MinInt64), got)
+	}
+}
+
+func TestNetworkState_Clone(t *testing.T) {
+	state := NewNetworkState(3, WithWatermarks())
+	state.AddLoad(0, 10)
+	state.AddLoad(1, 20)
+	state.PersistChanges()
+	state.AddLoad(2, 30) // pending in state, persisted in the clone
+
+	clone := state.Clone()
+
+	// Mutating the clone must not change the original state.
+	clone.AddLoad(0, 100)
+	clone.PersistChanges()
+	clone.AddLoad(1, 100)
+
+	// Mutating the original state must not change the clone.
+	state.UndoChanges()
+	state.AddLoad(1, 1000)
+
+	if diff := cmp.Diff([]int64{10, 1020, 0}, state.loads); diff != "" {
+		t.Errorf("state loads: mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]LoadChange{{1, 20}}, state.Changes()); diff != "" {
+		t.Errorf("state Changes(): mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]int64{10, 20, 0}, state.maxLoads); diff != "" {
+		t.Errorf("state watermarks: mismatch (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff([]int64{110, 120, 30}, clone.loads); diff != "" {
+		t.Errorf("clone loads: mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]LoadChange{{1, 20}}, clone.Changes()); diff != "" {
+		t.Errorf("clone Changes(): mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]int64{110, 20, 30}, clone.maxLoads); diff != "" {
+		t.Errorf("clone watermarks: mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNetworkState_Clone_checkpoints(t *testing.T) {
+	state := NewNetworkState(2)
+	state.AddLoad(0, 10)
+	state.Checkpoint()
+	state.AddLoad(1, 20)
+
+	clone := state.Clone()
+	clone.AddLoad(0, 5)
+	clone.UndoChanges()
+
+	if diff := cmp.Diff([]int64{10, 20}, clone.loads); diff != "" {
+		t.Errorf("clone loads: mismatch (-want +got):\n%s", diff)
+	}
+	if got := len(clone.checkpoints); got != 0 {
+		t.Errorf("clone checkpoints: want 0, got %d", got)
+	}
+}
+
+func TestNetworkState_Checkpoint_manyChanges(t *testing.T) {
+	nEdges := 4
+	nLevels := 10
+	state := NewNetworkState(nEdges)
+	cps := []Checkpoint{}
+
+	// Change all the edges in each of the nested checkpoints which requires
+	// recording nEdges*nLevels changes in total.
+	for l := 0; l < nLevels; l++ {
+		cps = append(cps, state.Checkpoint())
+		for e := 0; e < nEdges; e++ {
+			state.AddLoad(e, int64(e+1))
+		}
+	}
+	if got := state.ChangesCap(); got < nEdges*(nLevels+1) {
+		t.Errorf("ChangesCap(): want at least %d, got %d", nEdges*(nLevels+1), got)
+	}
+
+	state.RollbackTo(cps[nLevels/2])
+
+	for e := 0; e < nEdges; e++ {
+		want := int64((e + 1) * nLevels / 2)
+		if got := state.Load(e); got != want {
+			t.Errorf("Load(%d): want %d, got %d", e, want, got)
+		}
+	}
+
+	state.RollbackTo(cps[0])
+
+	for e := 0; e < nEdges; e++ {
+		if got := state.Load(e); got != 0 {
+			t.Errorf("Load(%d): want 0, got %d", e, got)
+		}
+	}
+	if got := state.Changes(); len(got) != 0 {
+		t.Errorf("Changes(): want no changes, got %v", got)
+	}
+}
+
+func TestNetworkState_Checkpoint_noAlloc(t *testing.T) {
+	state := NewNetworkState(100)
+	state.Checkpoint()
+	state.UndoChanges()
+
+	allocs := testing.AllocsPerRun(10, func() {
+		cp := state.Checkpoint()
+		for e := 0; e < 10; e++ {
+			state.AddLoad(e, 1)
+		}
+		state.RollbackTo(cp)
+		state.UndoChanges()
+	})
+
+	if allocs != 0 {
+		t.Errorf("Checkpoint(): want 0 allocations, got %f", allocs)
+	}
+}
+
+func TestNetworkState_AddLoad_loadCheck(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		ceiling   int64
+		add       int64
+		wantPanic bool
+	}{
+		{
+			desc: "valid load",
+			add:  -10,
+		},
+		{
+			desc:      "negative load",
+			add:       -11,
+			wantPanic: true,
+		},
+		{
+			desc:    "no ceiling",
+			ceiling: 0,
+			add:     math.MaxInt32,
+		},
+		{
+			desc:    "at ceiling",
+			ceiling: 100,
+			add:     90,
+		},
+		{
+			desc:      "above ceiling",
+			ceiling:   100,
+			add:       91,
+			wantPanic: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			state := NewNetworkState(2, WithLoadCheck(tc.ceiling))
+			state.loads[1] = 10
+
+			defer func() {
+				r := recover()
+				if gotPanic := r != nil; gotPanic != tc.wantPanic {
+					t.Fatalf("AddLoad(): want panic %t, got %t", tc.wantPanic, gotPanic)
+				}
+				if !tc.wantPanic {
+					return
+				}
+				err, ok := r.(*LoadError)
+				if !ok {
+					t.Fatalf("AddLoad(): want *LoadError, got %T", r)
+				}
+				if err.Edge != 1 {
+					t.Errorf("LoadError.Edge: want 1, got %d", err.Edge)
+				}
+				if len(err.Stack) == 0 {
+					t.Errorf("LoadError.Stack: want stack trace, got none")
+				}
+				if got := state.Load(1); got != 10 {
+					t.Errorf("Load(1): want 10, got %d", got)
+				}
+			}()
+
+			state.AddLoad(1, tc.add)
+		})
+	}
+}
+
+func TestNetworkState_AddLoad_noLoadCheck(t *testing.T) {
+	state := NewNetworkState(1)
+
+	state.RemoveLoad(0, 10) // no panic
+
+	if got := state.Load(0); got != -10 {
+		t.Errorf("Load(0): want -10, got %d", got)
+	}
+}
+
+func TestNetworkState_Validate(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		opts      []StateOption
+		loads     []int64
+		wantEdges []int
+	}{
+		{
+			desc:  "valid loads",
+			loads: []int64{0, 10, math.MaxInt64},
+		},
+		{
+			desc:      "negative loads",
+			loads:     []int64{-1, 10, -100},
+			wantEdges: []int{0, 2},
+		},
+		{
+			desc:      "ceiling",
+			opts:      []StateOption{WithLoadCheck(50)},
+			loads:     []int64{50, 51, -1},
+			wantEdges: []int{1, 2},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			state := NewNetworkState(len(tc.loads), tc.opts...)
+			copy(state.loads, tc.loads)
+
+			errs := state.Validate()
+
+			var gotEdges []int
+			for _, err := range errs {
+				var le *LoadError
+				if !errors.As(err, &le) {
+					t.Fatalf("Validate(): want *LoadError, got %T", err)
+				}
+				gotEdges = append(gotEdges, le.Edge)
+			}
+			if diff := cmp.Diff(tc.wantEdges, gotEdges); diff != "" {
+				t.Errorf("Validate(): edges mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func BenchmarkNetworkState_AddLoad(b *testing.B) {
+	benchmarks := []struct {
+		desc string
+		opts []StateOption
+	}{
+		{"default", nil},
+		{"overflow check", []StateOption{WithOverflowCheck()}},
+		{"load check", []StateOption{WithLoadCheck(0)}},
+		{"classes", []StateOption{WithClasses(4)}},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.desc, func(b *testing.B) {
+			nEdges := 1024
+			state := NewNetworkState(nEdges, bm.opts...)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				state.AddLoad(i%nEdges, 1)
+				if i%nEdges == nEdges-1 {
+					state.PersistChanges()
+				}
+			}
+		})
+	}
+}
+
+// TestNetworkState_AddLoad_inlinable verifies that the compiler can inline
+// AddLoad, which is required for its default path to be as fast as possible.
+func TestNetworkState_AddLoad_inlinable(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping compilation in short mode")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+
+	out, err := exec.Command("go", "build", "-gcflags=-m", ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("go build: %s\n%s", err, out)
+	}
+
+	if !bytes.Contains(out, []byte("can inline (*NetworkState).AddLoad")) {
+		t.Errorf("AddLoad(): want inlinable, got not inlinable")
+	}
+}
+
+func TestNetworkState_Changes_singleOccurrence(t *testing.T) {
+	want := []LoadChange{{3, 30}, {0, 0}, {1, 10}}
+	state := NewNetworkState(4)
+	state.loads = []int64{0, 10, 20, 30}
+
+	state.AddLoad(3, 1)
+	state.AddLoad(0, 5)
+	state.RemoveLoad(3, 1)
+	state.Checkpoint()
+	state.AddLoad(3, 7)
+	state.AddLoad(1, 1)
+	cp := state.Checkpoint()
+	state.RemoveLoad(0, 5)
+	state.AddLoad(2, 2)
+	state.RollbackTo(cp)
+	state.AddLoad(0, 3)
+	state.AddLoad(1, 3)
+	state.AddLoad(3, 3)
+
+	if diff := cmp.Diff(want, state.Changes()); diff != "" {
+		t.Errorf("Changes(): mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNetworkState_ChangesSorted(t *testing.T) {
+	want := []LoadChange{{0, 0}, {1, 10}, {3, 30}}
+	state := NewNetworkState(4)
+	state.loads = []int64{0, 10, 20, 30}
+
+	state.AddLoad(3, 1)
+	state.AddLoad(0, 5)
+	state.AddLoad(1, 5)
+	state.AddLoad(0, 5)
+	got := state.ChangesSorted()
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ChangesSorted(): mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]LoadChange{{3, 30}, {0, 0}, {1, 10}}, state.Changes()); diff != "" {
+		t.Errorf("Changes(): mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNetworkState_ForEachChange(t *testing.T) {
+	want := []LoadChange{{2, 0}, {0, 0}}
+	state := NewNetworkState(3)
+
+	state.AddLoad(2, 1)
+	state.AddLoad(0, 1)
+	state.AddLoad(2, 1)
+	got := []LoadChange{}
+	state.ForEachChange(func(lc LoadChange) {
+		got = append(got, lc)
+	})
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ForEachChange(): mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// allClassLoads returns the load of each class on each edge of the state.
+func allClassLoads(state *NetworkState) [][]int64 {
+	loads := make([][]int64, len(state.loads))
+	for e := range loads {
+		loads[e] = make([]int64, state.NumClasses())
+		for c := range loads[e] {
+			loads[e][c] = state.ClassLoad(e, c)
+		}
+	}
+	return loads
+}
+
+func TestNetworkState_AddClassLoad(t *testing.T) {
+	wantClassLoads := [][]int64{{10, 0, 5}, {0, 20, 0}, {30, 0, 0}}
+	wantLoads := []int64{15, 20, 30}
+	state := NewNetworkState(3, WithClasses(3))
+
+	state.AddClassLoad(0, 1, 20)
+	state.AddClassLoad(0, 2, 5)
+	state.AddLoad(0, 10) // class 0
+	state.PersistChanges()
+	state.RemoveClassLoad(0, 1, 20) // move class 1 from edge 0 to edge 1
+	state.AddClassLoad(1, 1, 20)
+	state.AddClassLoad(2, 0, 30)
+
+	if diff := cmp.Diff(wantClassLoads, allClassLoads(state)); diff != "" {
+		t.Errorf("ClassLoad(): mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(wantLoads, state.loads); diff != "" {
+		t.Errorf("Load(): mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNetworkState_UndoChanges_classes(t *testing.T) {
+	wantClassLoads := [][]int64{{10, 20}, {0, 0}, {0, 5}}
+	state := NewNetworkState(3, WithClasses(2))
+	state.AddLoad(0, 10)
+	state.AddClassLoad(0, 1, 20)
+	state.AddClassLoad(2, 1, 5)
+	state.PersistChanges()
+
+	state.RemoveClassLoad(0, 1, 20)
+	state.AddClassLoad(1, 1, 20)
+	state.AddClassLoad(0, 1, 7)
+	state.AddLoad(2, 3)
+	state.UndoChanges()
+
+	if diff := cmp.Diff(wantClassLoads, allClassLoads(state)); diff != "" {
+		t.Errorf("ClassLoad(): mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNetworkState_RollbackTo_classes(t *testing.T) {
+	state := NewNetworkState(2, WithClasses(2))
+	state.AddClassLoad(0, 1, 10)
+	state.PersistChanges()
+
+	state.AddClassLoad(0, 0, 1)
+	cp1 := state.Checkpoint()
+	state.AddClassLoad(0, 1, 2)
+	state.AddClassLoad(1, 1, 3)
+	cp2 := state.Checkpoint()
+	state.AddClassLoad(0, 1, 4)
+	state.AddClassLoad(1, 0, 5)
+
+	state.RollbackTo(cp2)
+	if diff := cmp.Diff([][]int64{{1, 12}, {0, 3}}, allClassLoads(state)); diff != "" {
+		t.Errorf("RollbackTo(cp2): mismatch (-want +got):\n%s", diff)
+	}
+
+	state.RollbackTo(cp1)
+	if diff := cmp.Diff([][]int64{{1, 10}, {0, 0}}, allClassLoads(state)); diff != "" {
+		t.Errorf("RollbackTo(cp1): mismatch (-want +got):\n%s", diff)
+	}
+
+	state.UndoChanges()
+	if diff := cmp.Diff([][]int64{{0, 10}, {0, 0}}, allClassLoads(state)); diff != "" {
+		t.Errorf("UndoChanges(): mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNetworkState_Clone_classes(t *testing.T) {
+	state := NewNetworkState(2, WithClasses(2))
+	state.AddClassLoad(0, 1, 10)
+	state.PersistChanges()
+	state.AddClassLoad(1, 1, 20) // pending in state, persisted in the clone
+
+	clone := state.Clone()
+	clone.AddClassLoad(0, 1, 100)
+	clone.UndoChanges()
+	state.UndoChanges()
+
+	if diff := cmp.Diff([][]int64{{0, 10}, {0, 0}}, allClassLoads(state)); diff != "" {
+		t.Errorf("state ClassLoad(): mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([][]int64{{0, 10}, {0, 20}}, allClassLoads(clone)); diff != "" {
+		t.Errorf("clone ClassLoad(): mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNetworkState_AddClassLoad_invalid(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		state *NetworkState
+		class int
+	}{
+		{"classes disabled", NewNetworkState(3), 0},
+		{"negative class", NewNetworkState(3, WithClasses(2)), -1},
+		{"class too large", NewNetworkState(3, WithClasses(2)), 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("AddClassLoad(): want panic, got none")
+				}
+			}()
+
+			tc.state.AddClassLoad(0, tc.class, 1)
+		})
+	}
+}